@@ -0,0 +1,96 @@
+package apps
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func makeTestBundle(t *testing.T, files map[string]string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestArchiveFileServerRoundTrip(t *testing.T) {
+	styleCSS := "body { color: red; }"
+	// Not a real image, but exercises a non-gzippable extension.
+	logoPNG := string([]byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a, 1, 2, 3, 4})
+
+	bundle := makeTestBundle(t, map[string]string{
+		"style.css": styleCSS,
+		"logo.png":  logoPNG,
+	})
+
+	fs := afero.NewMemMapFs()
+	if err := BuildArchiveIndex(fs, "myapp", "1.0.0", bundle); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewArchiveFileServer(fs)
+
+	for name, want := range map[string]string{"style.css": styleCSS, "logo.png": logoPNG} {
+		sum := sha256.Sum256([]byte(want))
+		wantEtag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+		info, err := srv.Stat("myapp", "1.0.0", name)
+		if err != nil {
+			t.Fatalf("Stat(%s): %v", name, err)
+		}
+		if info.Size != int64(len(want)) {
+			t.Errorf("%s: Size = %d, want %d (the uncompressed size, matching SHA256)", name, info.Size, len(want))
+		}
+		if info.Etag != wantEtag {
+			t.Errorf("%s: Etag = %s, want %s", name, info.Etag, wantEtag)
+		}
+
+		r, err := srv.Open("myapp", "1.0.0", name)
+		if err != nil {
+			t.Fatalf("Open(%s): %v", name, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: Open content = %q, want %q", name, got, want)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/"+name, nil)
+		w := httptest.NewRecorder()
+		if err := srv.ServeFileContent(w, req, "myapp", "1.0.0", name); err != nil {
+			t.Fatalf("ServeFileContent(%s): %v", name, err)
+		}
+		if w.Body.String() != want {
+			t.Errorf("%s: ServeFileContent body = %q, want %q", name, w.Body.String(), want)
+		}
+		if enc := w.Header().Get("Content-Encoding"); enc != "" {
+			t.Errorf("%s: Content-Encoding = %q, want empty (client sent no Accept-Encoding)", name, enc)
+		}
+	}
+}
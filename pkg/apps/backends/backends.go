@@ -0,0 +1,67 @@
+// Package backends provides the pluggable object-storage drivers used to
+// build an apps.FileServer. Each driver turns a DSN-like URL into an
+// afero.Fs, so apps.NewFileServer can pick the backend at runtime and
+// compose it with a read-through disk cache without any call site caring
+// which store actually holds the app files.
+//
+// Built-in drivers:
+//   - file:///var/lib/cozy/apps  a local directory (afero.OsFs rooted at the path)
+//   - mem://                     an in-memory filesystem, for tests
+//   - s3://bucket/prefix         an AWS S3 bucket
+//   - swift://container          an OpenStack Swift container
+package backends
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// Driver builds an afero.Fs from a parsed DSN.
+type Driver func(dsn *url.URL) (afero.Fs, error)
+
+var (
+	mu      sync.Mutex
+	drivers = make(map[string]Driver)
+)
+
+func init() {
+	Register("file", func(dsn *url.URL) (afero.Fs, error) {
+		return afero.NewBasePathFs(afero.NewOsFs(), dsn.Path), nil
+	})
+	Register("mem", func(dsn *url.URL) (afero.Fs, error) {
+		return afero.NewMemMapFs(), nil
+	})
+}
+
+// Register makes a driver available under the given DSN scheme. It panics
+// if a driver is already registered for that scheme, mirroring the
+// database/sql driver registry.
+func Register(scheme string, driver Driver) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := drivers[scheme]; ok {
+		panic("backends: driver already registered for scheme " + scheme)
+	}
+	drivers[scheme] = driver
+}
+
+// New parses dsn and returns the afero.Fs built by the driver registered
+// for its scheme.
+func New(dsn string) (afero.Fs, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("backends: invalid dsn %q: %s", dsn, err)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	mu.Lock()
+	driver, ok := drivers[scheme]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("backends: no driver registered for scheme %q", scheme)
+	}
+	return driver(u)
+}
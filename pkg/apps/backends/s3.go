@@ -0,0 +1,155 @@
+package backends
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// S3Client is the narrow, read-only slice of an S3-compatible client that
+// the "s3" driver needs. Wire any SDK (aws-sdk-go, minio-go, ...) to it
+// with a small adapter and pass it to RegisterS3Client, the same way
+// RegisterSwiftConn expects a *swift.Connection for the "swift" driver.
+type S3Client interface {
+	GetObject(bucket, key string) (body io.ReadCloser, size int64, err error)
+	HeadObject(bucket, key string) (size int64, modTime time.Time, err error)
+}
+
+// ErrS3ClientNotConfigured is returned by the s3 driver when an s3://
+// bucket/prefix DSN is resolved before RegisterS3Client has been called.
+var ErrS3ClientNotConfigured = errors.New("backends: s3 client not configured, call RegisterS3Client first")
+
+var (
+	s3Mu     sync.Mutex
+	s3Client S3Client
+)
+
+func init() {
+	Register("s3", func(dsn *url.URL) (afero.Fs, error) {
+		s3Mu.Lock()
+		c := s3Client
+		s3Mu.Unlock()
+		if c == nil {
+			return nil, ErrS3ClientNotConfigured
+		}
+		return &s3Fs{
+			c:      c,
+			bucket: dsn.Host,
+			prefix: strings.TrimPrefix(dsn.Path, "/"),
+		}, nil
+	})
+}
+
+// RegisterS3Client sets the S3Client used by the "s3" driver. It must be
+// called once, during cozy-stack's object-storage setup, before any s3://
+// DSN is resolved through New.
+func RegisterS3Client(c S3Client) {
+	s3Mu.Lock()
+	s3Client = c
+	s3Mu.Unlock()
+}
+
+// s3Fs is a read-mostly afero.Fs backed by a single S3 bucket/prefix. It
+// mirrors swiftFs: app files are written once at install time through the
+// regular upload path, so s3Fs only needs to support reads and reports
+// os.ErrPermission for the mutating afero.Fs methods it does not
+// implement.
+type s3Fs struct {
+	c      S3Client
+	bucket string
+	prefix string
+}
+
+func (fs *s3Fs) key(name string) string {
+	return path.Join(fs.prefix, strings.TrimPrefix(path.Clean(name), "/"))
+}
+
+func (fs *s3Fs) Name() string { return "s3://" + path.Join(fs.bucket, fs.prefix) }
+
+func (fs *s3Fs) Open(name string) (afero.File, error) {
+	r, size, err := fs.c.GetObject(fs.bucket, fs.key(name))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &s3File{r: r, name: name, size: size}, nil
+}
+
+func (fs *s3Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE) != 0 {
+		return nil, os.ErrPermission
+	}
+	return fs.Open(name)
+}
+
+func (fs *s3Fs) Stat(name string) (os.FileInfo, error) {
+	size, modTime, err := fs.c.HeadObject(fs.bucket, fs.key(name))
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return &s3FileInfo{name: name, size: size, modTime: modTime}, nil
+}
+
+func (fs *s3Fs) Create(name string) (afero.File, error)                 { return nil, os.ErrPermission }
+func (fs *s3Fs) Mkdir(name string, perm os.FileMode) error              { return os.ErrPermission }
+func (fs *s3Fs) MkdirAll(path string, perm os.FileMode) error           { return os.ErrPermission }
+func (fs *s3Fs) Remove(name string) error                               { return os.ErrPermission }
+func (fs *s3Fs) RemoveAll(path string) error                            { return os.ErrPermission }
+func (fs *s3Fs) Rename(oldname, newname string) error                   { return os.ErrPermission }
+func (fs *s3Fs) Chmod(name string, mode os.FileMode) error              { return os.ErrPermission }
+func (fs *s3Fs) Chtimes(name string, atime, mtime time.Time) error      { return os.ErrPermission }
+func (fs *s3Fs) Chown(name string, uid, gid int) error                  { return os.ErrPermission }
+
+// s3File adapts the ReadCloser returned by S3Client.GetObject to the
+// afero.File interface for the read path exercised by FileServer.Open and
+// ServeFileContent. It does not support ReadAt/Seek: S3Client has no range
+// request, so both return os.ErrInvalid, and reading an S3-backed archive
+// blob through archiveServer fails with that error on the first read. For the
+// same reason, an s3Fs must only be reached through apps.NewFileServer with
+// Config.CacheDir set: that wraps it in afero.CacheOnReadFs, so
+// http.ServeContent's mandatory size-probing Seek lands on a real, seekable
+// file in the local cache layer instead of on this one. NewFileServer
+// enforces this with apps.ErrS3RequiresCacheDir.
+type s3File struct {
+	r    io.ReadCloser
+	name string
+	size int64
+}
+
+func (f *s3File) Read(p []byte) (int, error) { return f.r.Read(p) }
+func (f *s3File) Close() error                { return f.r.Close() }
+func (f *s3File) Name() string                { return f.name }
+
+func (f *s3File) Stat() (os.FileInfo, error) {
+	return &s3FileInfo{name: f.name, size: f.size}, nil
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error)      { return 0, os.ErrInvalid }
+func (f *s3File) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (f *s3File) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+func (f *s3File) WriteAt(p []byte, off int64) (int, error)     { return 0, os.ErrPermission }
+func (f *s3File) WriteString(s string) (int, error)            { return 0, os.ErrPermission }
+func (f *s3File) Truncate(size int64) error                    { return os.ErrPermission }
+func (f *s3File) Sync() error                                  { return nil }
+func (f *s3File) Readdir(count int) ([]os.FileInfo, error)      { return nil, os.ErrInvalid }
+func (f *s3File) Readdirnames(n int) ([]string, error)          { return nil, os.ErrInvalid }
+
+// s3FileInfo adapts S3Client metadata to os.FileInfo.
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *s3FileInfo) Name() string       { return path.Base(fi.name) }
+func (fi *s3FileInfo) Size() int64        { return fi.size }
+func (fi *s3FileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *s3FileInfo) IsDir() bool        { return false }
+func (fi *s3FileInfo) Sys() interface{}   { return nil }
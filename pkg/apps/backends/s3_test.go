@@ -0,0 +1,100 @@
+package backends
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+type fakeS3Client struct {
+	objects map[string][]byte
+	modTime time.Time
+}
+
+func (c *fakeS3Client) GetObject(bucket, key string) (io.ReadCloser, int64, error) {
+	data, ok := c.objects[bucket+"/"+key]
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (c *fakeS3Client) HeadObject(bucket, key string) (int64, time.Time, error) {
+	data, ok := c.objects[bucket+"/"+key]
+	if !ok {
+		return 0, time.Time{}, os.ErrNotExist
+	}
+	return int64(len(data)), c.modTime, nil
+}
+
+func TestS3FsOpenAndStat(t *testing.T) {
+	client := &fakeS3Client{
+		objects: map[string][]byte{
+			"mybucket/myapp/1.0.0/index.html": []byte("<html></html>"),
+		},
+		modTime: time.Now(),
+	}
+	RegisterS3Client(client)
+	defer RegisterS3Client(nil)
+
+	fs, err := New("s3://mybucket/myapp/1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := fs.Stat("index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len("<html></html>")) {
+		t.Errorf("Size() = %d, want %d", info.Size(), len("<html></html>"))
+	}
+
+	f, err := fs.Open("index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "<html></html>" {
+		t.Errorf("Open content = %q, want %q", got, "<html></html>")
+	}
+}
+
+func TestS3FsOpenNotConfigured(t *testing.T) {
+	RegisterS3Client(nil)
+	if _, err := New("s3://mybucket/myapp"); err != ErrS3ClientNotConfigured {
+		t.Fatalf("New() error = %v, want ErrS3ClientNotConfigured", err)
+	}
+}
+
+func TestS3FileNotSeekable(t *testing.T) {
+	client := &fakeS3Client{
+		objects: map[string][]byte{"mybucket/app.js": []byte("console.log(1)")},
+	}
+	RegisterS3Client(client)
+	defer RegisterS3Client(nil)
+
+	fs, err := New("s3://mybucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("app.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(0, io.SeekEnd); err == nil {
+		t.Error("Seek() = nil error, want an error (s3File is documented as non-seekable)")
+	}
+	var _ afero.Fs = fs
+}
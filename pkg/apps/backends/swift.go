@@ -0,0 +1,173 @@
+package backends
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/swift"
+	"github.com/spf13/afero"
+)
+
+// ErrSwiftConnNotConfigured is returned by the swift driver when a
+// swift://container DSN is resolved before RegisterSwiftConn has been
+// called with the connection to use.
+var ErrSwiftConnNotConfigured = errors.New("backends: swift connection not configured, call RegisterSwiftConn first")
+
+var (
+	swiftMu   sync.Mutex
+	swiftConn *swift.Connection
+)
+
+func init() {
+	Register("swift", func(dsn *url.URL) (afero.Fs, error) {
+		swiftMu.Lock()
+		conn := swiftConn
+		swiftMu.Unlock()
+		if conn == nil {
+			return nil, ErrSwiftConnNotConfigured
+		}
+		return &swiftFs{c: conn, container: dsn.Host}, nil
+	})
+}
+
+// RegisterSwiftConn sets the *swift.Connection used by the "swift" driver.
+// It must be called once, during cozy-stack's Swift client setup, before
+// any swift:// DSN is resolved through New.
+func RegisterSwiftConn(conn *swift.Connection) {
+	swiftMu.Lock()
+	swiftConn = conn
+	swiftMu.Unlock()
+}
+
+// swiftFs is a read-mostly afero.Fs backed by a single Swift container. It
+// exists so that apps.NewFileServer can compose Swift with the same
+// read-through cache used for the other drivers. App files are written once
+// at install time through the regular swift.Connection, so swiftFs only
+// needs to support reads and reports os.ErrPermission for the mutating
+// afero.Fs methods it does not implement.
+type swiftFs struct {
+	c         *swift.Connection
+	container string
+}
+
+func (fs *swiftFs) Name() string { return "swift:" + fs.container }
+
+func (fs *swiftFs) Open(name string) (afero.File, error) {
+	objName := objectName(name)
+	f, _, err := fs.c.ObjectOpen(fs.container, objName, false, nil)
+	if err != nil {
+		return nil, wrapErr(objName, err)
+	}
+	size, err := f.Length()
+	if err != nil {
+		f.Close()
+		return nil, wrapErr(objName, err)
+	}
+	return &swiftFile{f: f, name: name, size: size}, nil
+}
+
+func (fs *swiftFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE) != 0 {
+		return nil, os.ErrPermission
+	}
+	return fs.Open(name)
+}
+
+func (fs *swiftFs) Stat(name string) (os.FileInfo, error) {
+	objName := objectName(name)
+	o, _, err := fs.c.Object(fs.container, objName)
+	if err != nil {
+		return nil, wrapErr(objName, err)
+	}
+	return &swiftFileInfo{o: o}, nil
+}
+
+func (fs *swiftFs) Create(name string) (afero.File, error)                  { return nil, os.ErrPermission }
+func (fs *swiftFs) Mkdir(name string, perm os.FileMode) error               { return os.ErrPermission }
+func (fs *swiftFs) MkdirAll(path string, perm os.FileMode) error            { return os.ErrPermission }
+func (fs *swiftFs) Remove(name string) error                               { return os.ErrPermission }
+func (fs *swiftFs) RemoveAll(path string) error                            { return os.ErrPermission }
+func (fs *swiftFs) Rename(oldname, newname string) error                   { return os.ErrPermission }
+func (fs *swiftFs) Chmod(name string, mode os.FileMode) error              { return os.ErrPermission }
+func (fs *swiftFs) Chtimes(name string, atime, mtime time.Time) error      { return os.ErrPermission }
+func (fs *swiftFs) Chown(name string, uid, gid int) error                  { return os.ErrPermission }
+
+func objectName(name string) string {
+	return strings.TrimPrefix(path.Clean(name), "/")
+}
+
+func wrapErr(name string, err error) error {
+	if err == swift.ObjectNotFound || err == swift.ContainerNotFound {
+		return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// swiftFile adapts a swift.File to the afero.File interface for the read
+// path exercised by FileServer.Open and ServeFileContent.
+type swiftFile struct {
+	f    *swift.ObjectOpenFile
+	name string
+	size int64
+}
+
+func (f *swiftFile) Read(p []byte) (int, error) { return f.f.Read(p) }
+
+// ReadAt has no native counterpart on *swift.ObjectOpenFile: there is no
+// range-read primitive below Seek. Seek already re-opens the object with an
+// HTTP Range header, so ReadAt composes Seek and Read, same as os.File's
+// ReadAt would for a non-concurrent-safe handle; swiftFile is not meant to
+// be shared across goroutines, matching the rest of the afero.File usage
+// in this package.
+func (f *swiftFile) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := f.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(f.f, p)
+}
+
+func (f *swiftFile) Seek(offset int64, whence int) (int64, error) { return f.f.Seek(offset, whence) }
+func (f *swiftFile) Close() error                                { return f.f.Close() }
+func (f *swiftFile) Name() string                                { return f.name }
+
+func (f *swiftFile) Stat() (os.FileInfo, error) {
+	return &swiftFileInfo{name: f.name, size: f.size}, nil
+}
+
+func (f *swiftFile) Write(p []byte) (int, error)                    { return 0, os.ErrPermission }
+func (f *swiftFile) WriteAt(p []byte, off int64) (int, error)       { return 0, os.ErrPermission }
+func (f *swiftFile) WriteString(s string) (int, error)              { return 0, os.ErrPermission }
+func (f *swiftFile) Truncate(size int64) error                      { return os.ErrPermission }
+func (f *swiftFile) Sync() error                                    { return nil }
+func (f *swiftFile) Readdir(count int) ([]os.FileInfo, error)       { return nil, os.ErrInvalid }
+func (f *swiftFile) Readdirnames(n int) ([]string, error)           { return nil, os.ErrInvalid }
+
+// swiftFileInfo adapts swift.Object metadata to os.FileInfo.
+type swiftFileInfo struct {
+	o    swift.Object
+	name string
+	size int64
+}
+
+func (fi *swiftFileInfo) Name() string {
+	if fi.name != "" {
+		return path.Base(fi.name)
+	}
+	return path.Base(fi.o.Name)
+}
+func (fi *swiftFileInfo) Size() int64 {
+	if fi.o.Name != "" {
+		return fi.o.Bytes
+	}
+	return fi.size
+}
+func (fi *swiftFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *swiftFileInfo) ModTime() time.Time { return fi.o.LastModified }
+func (fi *swiftFileInfo) IsDir() bool        { return false }
+func (fi *swiftFileInfo) Sys() interface{}   { return nil }
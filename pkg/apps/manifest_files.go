@@ -0,0 +1,25 @@
+package apps
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ServeManifestFiles writes the JSON listing of every file shipped by
+// (slug, version), built from srv.Walk. It is meant to be registered as the
+// handler for "GET /apps/:slug/manifest/files", with slug and the app's
+// installed version coming from the route, so the client stack and the
+// permission subsystem can reason about the shipped bundle without
+// shelling into the underlying store.
+func ServeManifestFiles(w http.ResponseWriter, req *http.Request, srv FileServer, slug, version string) error {
+	entries := make([]FileEntry, 0)
+	err := srv.Walk(slug, version, func(fe FileEntry) error {
+		entries = append(entries, fe)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,114 @@
+package apps
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// The MaxFileSize policy must compare against the real, served (logical)
+// size of a file, not an on-disk compressed size. This guards the coupling
+// between SecureFileServer and whatever FileServer it wraps: had the
+// chunk0-3 Size/SHA256 mismatch resurfaced, a gzip-precompressed text
+// asset larger than the limit would silently slip through.
+func TestSecureFileServerMaxFileSizeUsesLogicalSize(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 10000) // compresses very well
+	bundle := makeTestBundle(t, map[string]string{"big.js": string(content)})
+
+	fs := afero.NewMemMapFs()
+	if err := BuildArchiveIndex(fs, "myapp", "1.0.0", bundle); err != nil {
+		t.Fatal(err)
+	}
+	inner := NewArchiveFileServer(fs)
+
+	// The stored (compressed) bytes are much smaller than the real file,
+	// so a naive compressed-size check would let this file through.
+	srv := NewSecureFileServer(inner, FileServerPolicy{MaxFileSize: int64(len(content)) - 1})
+
+	_, err := srv.Open("myapp", "1.0.0", "big.js")
+	if err != ErrFileTooLarge {
+		t.Fatalf("Open() error = %v, want ErrFileTooLarge", err)
+	}
+}
+
+func TestSecureFileServerPathEscape(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/myapp/1.0.0/index.html", []byte("ok"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "/secret", []byte("nope"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inner := NewAferoFileServer(fs, nil)
+	srv := NewSecureFileServer(inner, FileServerPolicy{})
+
+	if _, err := srv.Open("myapp", "1.0.0", "../../secret"); err != ErrPathEscape {
+		t.Fatalf("Open() error = %v, want ErrPathEscape", err)
+	}
+}
+
+func TestSecureFileServerSymlinkDenied(t *testing.T) {
+	root := t.TempDir()
+	appDir := filepath.Join(root, "myapp", "1.0.0")
+	if err := os.MkdirAll(appDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(root, "secret")
+	if err := os.WriteFile(secret, []byte("nope"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(appDir, "link")
+	if err := os.Symlink(secret, link); err != nil {
+		t.Skipf("symlinks not supported in this environment: %s", err)
+	}
+
+	fs := afero.NewBasePathFs(afero.NewOsFs(), root)
+	inner := NewAferoFileServer(fs, nil)
+	srv := NewSecureFileServer(inner, FileServerPolicy{})
+
+	if _, err := srv.Open("myapp", "1.0.0", "link"); err != ErrSymlinkDenied {
+		t.Fatalf("Open() error = %v, want ErrSymlinkDenied", err)
+	}
+}
+
+func TestSecureFileServerMaxOpenFiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/myapp/1.0.0/index.html", []byte("ok"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inner := NewAferoFileServer(fs, nil)
+	srv := NewSecureFileServer(inner, FileServerPolicy{MaxOpenFiles: 1})
+
+	r, err := srv.Open("myapp", "1.0.0", "index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Open("myapp", "1.0.0", "index.html"); err != ErrTooManyOpenFiles {
+		t.Fatalf("second Open() error = %v, want ErrTooManyOpenFiles", err)
+	}
+	r.Close()
+	if _, err := srv.Open("myapp", "1.0.0", "index.html"); err != nil {
+		t.Fatalf("Open() after release = %v, want nil", err)
+	}
+}
+
+func TestSecureFileServerServeFileContentRejectsEscape(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "/myapp/1.0.0/index.html", []byte("ok"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inner := NewAferoFileServer(fs, nil)
+	srv := NewSecureFileServer(inner, FileServerPolicy{})
+
+	req := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+	w := httptest.NewRecorder()
+	if err := srv.ServeFileContent(w, req, "myapp", "1.0.0", "../../secret"); err != ErrPathEscape {
+		t.Fatalf("ServeFileContent() error = %v, want ErrPathEscape", err)
+	}
+}
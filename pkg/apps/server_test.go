@@ -0,0 +1,106 @@
+package apps
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestAferoFileServerEtagFromManifest(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	content := []byte("console.log('hello')")
+	if err := afero.WriteFile(fs, "/myapp/1.0.0/app.js", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := BuildFileEtags(fs, defaultMakePath, "myapp", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	// Change the file after the manifest is written, so a re-hash would no
+	// longer match the SHA-256 of the original content.
+	if err := afero.WriteFile(fs, "/myapp/1.0.0/app.js", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewAferoFileServer(fs, nil)
+	info, err := srv.Stat("myapp", "1.0.0", "app.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	want := `"` + hex.EncodeToString(sum[:]) + `"`
+	if info.Etag != want {
+		t.Errorf("Etag = %s, want %s (persisted manifest should be used, not re-hashed)", info.Etag, want)
+	}
+
+	entries, err := srv.ReadDir("myapp", "1.0.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "app.js" {
+		t.Fatalf("ReadDir = %+v, want a single app.js entry (the .etags.json sidecar must not be listed)", entries)
+	}
+}
+
+func TestAferoFileServerEtagFallbackWithoutManifest(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	content := []byte("body { color: red }")
+	if err := afero.WriteFile(fs, "/myapp/1.0.0/style.css", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// No BuildFileEtags call: exercises the pre-feature / retro-compat path.
+	srv := NewAferoFileServer(fs, nil)
+	info, err := srv.Stat("myapp", "1.0.0", "style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	want := `"` + hex.EncodeToString(sum[:]) + `"`
+	if info.Etag != want {
+		t.Errorf("Etag = %s, want %s", info.Etag, want)
+	}
+}
+
+// TestAferoFileServerEtagConcurrentNoManifestRace reproduces concurrent
+// Stat calls for distinct files of the same un-migrated app (no persisted
+// .etags.json yet): one goroutine's on-demand insert into the shared
+// per-app manifest map must not race with another goroutine's lookup.
+// Run with -race to catch a regression.
+func TestAferoFileServerEtagConcurrentNoManifestRace(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	names := []string{"a.js", "b.js", "c.js", "d.js"}
+	for _, name := range names {
+		if err := afero.WriteFile(fs, "/myapp/1.0.0/"+name, []byte("content-"+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := NewAferoFileServer(fs, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		for _, name := range names {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				if _, err := srv.Stat("myapp", "1.0.0", name); err != nil {
+					t.Error(err)
+				}
+			}(name)
+		}
+	}
+	wg.Wait()
+}
+
+func TestNewFileServerRequiresCacheDirForS3(t *testing.T) {
+	if _, err := NewFileServer(&Config{DSN: "s3://mybucket/myapp"}); err != ErrS3RequiresCacheDir {
+		t.Fatalf("NewFileServer() error = %v, want ErrS3RequiresCacheDir", err)
+	}
+	if _, err := NewFileServer(&Config{DSN: "mem://", CacheDir: ""}); err != nil {
+		t.Fatalf("NewFileServer() for a non-s3 DSN with no CacheDir = %v, want nil", err)
+	}
+}